@@ -1,17 +1,30 @@
 package main
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/rjeczalik/notify"
-	"gopkg.in/dickeyxxx/golock.v1"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -21,8 +34,14 @@ const (
 	RepoDir = "/repo"
 	// LogDir the parent log directory for the application
 	LogDir = "/logs/repo-scanner"
-	// LockFileName the name of the lockfile
-	LockFileName = "repoUpdate.lock"
+	// DefaultDebounceMS the default quiet period before an update runs, in milliseconds
+	DefaultDebounceMS = 2000
+	// FileLockDir the directory holding the opt-in flock(2) files used for cross-instance coordination
+	FileLockDir = "/var/lock/repo-scanner"
+	// DefaultCASDir the default content-addressed blob store directory, relative to RepoDir
+	DefaultCASDir = RepoDir + "/.cas"
+	// DefaultCASGCInterval the default period between sweeps removing orphaned CAS blobs
+	DefaultCASGCInterval = time.Hour
 )
 
 // Global Variables
@@ -66,28 +85,614 @@ func checkErrorAndLog(e error) {
 	}
 }
 
+// getEnvInt(name string, def int) int
+// This will read an env variable as a positive int, falling back to a default
+// This will take in the env variable name and the default value
+// This will return the parsed int, or the default if unset or invalid
+func getEnvInt(name string, def int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		log.Warnf("Invalid value %q for %s, using default of %d", val, name, def)
+		return def
+	}
+
+	return n
+}
+
+// getEnvDurationMS(name string, def time.Duration) time.Duration
+// This will read an env variable as a millisecond duration, falling back to a default
+// This will take in the env variable name and the default duration
+// This will return the parsed duration, or the default if unset or invalid
+func getEnvDurationMS(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+
+	ms, err := strconv.Atoi(val)
+	if err != nil || ms <= 0 {
+		log.Warnf("Invalid value %q for %s, using default of %s", val, name, def)
+		return def
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+// workerPool runs handle for repo directories across a bounded set of
+// goroutines. A second request for a path that is already running is
+// coalesced into exactly one queued follow-up run instead of piling up.
+// The backlog is an unbounded slice guarded by mu/cond rather than a
+// fixed-size channel, so enqueue and the workers' post-processing never
+// have to block on a full channel while holding mu.
+type workerPool struct {
+	handle  func(string)
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []string
+	active  map[string]bool
+	pending map[string]bool
+}
+
+// newWorkerPool(size int, handle func(string)) *workerPool
+// This will start a worker pool with the given number of worker goroutines, each running handle
+// This will take in the desired pool size and the function to run for each enqueued path
+// This will return a pointer to the new workerPool
+func newWorkerPool(size int, handle func(string)) *workerPool {
+	p := &workerPool{
+		handle:  handle,
+		active:  make(map[string]bool),
+		pending: make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := 0; i < size; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+// (p *workerPool) worker()
+// This will pull repo paths off the backlog and run handle for each, re-queuing the path if
+// another update was requested while it was running
+// This will take in nothing
+// This will return nothing
+func (p *workerPool) worker() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 {
+			p.cond.Wait()
+		}
+		path := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		p.handle(path)
+
+		p.mu.Lock()
+		if p.pending[path] {
+			delete(p.pending, path)
+			p.queue = append(p.queue, path)
+			p.cond.Signal()
+		} else {
+			delete(p.active, path)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// (p *workerPool) enqueue(path string)
+// This will schedule a handle run for path, coalescing it into the in-flight
+// run for that path if one is already active
+// This will take in the repo path to update
+// This will return nothing
+func (p *workerPool) enqueue(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[path] {
+		p.pending[path] = true
+		return
+	}
+
+	p.active[path] = true
+	p.queue = append(p.queue, path)
+	p.cond.Signal()
+}
+
+// debouncer coalesces a burst of filesystem events for the same directory
+// into a single workerPool.enqueue call once no further events arrive for
+// the configured quiet period
+type debouncer struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	delay  time.Duration
+	pool   *workerPool
+}
+
+// newDebouncer(delay time.Duration, pool *workerPool) *debouncer
+// This will create a debouncer that enqueues onto pool after delay of silence
+// This will take in the quiet period and the worker pool to enqueue onto
+// This will return a pointer to the new debouncer
+func newDebouncer(delay time.Duration, pool *workerPool) *debouncer {
+	return &debouncer{
+		timers: make(map[string]*time.Timer),
+		delay:  delay,
+		pool:   pool,
+	}
+}
+
+// (d *debouncer) trigger(path string)
+// This will (re)start path's quiet-period timer, enqueuing an update on the
+// worker pool once the timer fires without being reset again
+// This will take in the repo path that changed
+// This will return nothing
+func (d *debouncer) trigger(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[path]; ok {
+		t.Reset(d.delay)
+		return
+	}
+
+	d.timers[path] = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		delete(d.timers, path)
+		d.mu.Unlock()
+
+		d.pool.enqueue(path)
+	})
+}
+
+// repoLocker serializes updateRepo runs per directory with an in-process mutex, replacing the
+// old golock-based lockfile written into the repo directory itself
+type repoLocker struct {
+	mutexes sync.Map // path -> *sync.Mutex
+}
+
+// (l *repoLocker) Lock(path string) func()
+// This will acquire the mutex for path, creating it on first use
+// This will take in the repo path
+// This will return an unlock function to release it
+func (l *repoLocker) Lock(path string) func() {
+	v, _ := l.mutexes.LoadOrStore(path, &sync.Mutex{})
+	m := v.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+// Var to hold the in-process per-directory locker used by updateRepo
+var locker = &repoLocker{}
+
+// fileLockPath(path string) string
+// This will compute the hidden flock(2) file path used for path under USE_FILE_LOCK, named by
+// the SHA-1 of the repo path so it never collides with or appears inside the repodata tree
+// This will take in the repo path
+// This will return the absolute path of its lock file
+func fileLockPath(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return FileLockDir + "/" + hex.EncodeToString(sum[:]) + ".lock"
+}
+
+// acquireFileLock(path string) (*os.File, error)
+// This will flock(2) the hidden lock file for path, for cross-instance coordination on shared
+// storage such as an NFS-mounted /repo
+// This will take in the repo path
+// This will return the open, locked file (to be released with releaseFileLock) or an error
+func acquireFileLock(path string) (*os.File, error) {
+	lockPath := fileLockPath(path)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// releaseFileLock(f *os.File)
+// This will unlock and close a lock file acquired with acquireFileLock
+// This will take in the open, locked file
+// This will return nothing
+func releaseFileLock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// casEnabled() bool
+// This will report whether content-addressed RPM storage is turned on
+// This will take in nothing
+// This will return true if CAS_ENABLED is "true"
+func casEnabled() bool {
+	return strings.ToLower(os.Getenv("CAS_ENABLED")) == "true"
+}
+
+// casDir() string
+// This will return the configured CAS blob store directory
+// This will take in nothing
+// This will return CAS_DIR, or DefaultCASDir if unset
+func casDir() string {
+	dir := os.Getenv("CAS_DIR")
+	if dir == "" {
+		return DefaultCASDir
+	}
+	return dir
+}
+
+// casBlobPath(hash string) string
+// This will compute the blob path for an RPM's content hash, sharded by the first two hex digits
+// This will take in the SHA-256 hex digest of an RPM's contents
+// This will return its path under the CAS directory
+func casBlobPath(hash string) string {
+	return filepath.Join(casDir(), hash[:2], hash+".rpm")
+}
+
+// hashFile(path string) (string, error)
+// This will compute the SHA-256 digest of a file's contents
+// This will take in the file path
+// This will return the hex-encoded digest, or an error if the file could not be read
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile(src, dst string) error
+// This will copy a file's contents, used as a fallback when link(2) fails across filesystems
+// This will take in the source and destination paths
+// This will return an error if the copy failed
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// ingestIntoCAS(rpmPath string) error
+// This will hash rpmPath into the CAS, storing it once under CAS_DIR and replacing rpmPath with
+// a hardlink back to that blob
+// This will take in the path of an RPM already present in a repo directory
+// This will return an error if hashing, storing, or relinking failed
+func ingestIntoCAS(rpmPath string) error {
+	hash, err := hashFile(rpmPath)
+	if err != nil {
+		return err
+	}
+
+	blobPath := casBlobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+		if err := os.Link(rpmPath, blobPath); err != nil {
+			// Cross-filesystem hardlinks aren't possible, fall back to a copy
+			if err := copyFile(rpmPath, blobPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	tmpPath := rpmPath + ".cas-tmp"
+	os.Remove(tmpPath)
+	if err := os.Link(blobPath, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, rpmPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// rename(2) is a no-op when rpmPath is already a link to the blob, leaving tmpPath behind
+	os.Remove(tmpPath)
+
+	return nil
+}
+
+// ingestRPMsToCAS(path string)
+// This will dedup every RPM currently in a repo directory into the CAS, ahead of createrepo
+// This will take in the repo directory path
+// This will return nothing, logging any per-file failures
+func ingestRPMsToCAS(path string) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Errorf("Failed to list %s for CAS ingest: %s", path, err.Error())
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !rpmRegex.MatchString(file.Name()) {
+			continue
+		}
+
+		rpmPath := path + "/" + file.Name()
+		if err := ingestIntoCAS(rpmPath); err != nil {
+			log.Errorf("Failed to ingest %s into CAS: %s", rpmPath, err.Error())
+		}
+	}
+}
+
+// casStatsResponse is the JSON shape returned by GET /cas/stats
+type casStatsResponse struct {
+	TotalBlobs        int   `json:"totalBlobs"`
+	TotalLogicalBytes int64 `json:"totalLogicalBytes"`
+	BytesSaved        int64 `json:"bytesSaved"`
+}
+
+// casStatsSnapshot() (casStatsResponse, error)
+// This will walk the CAS directory and total blob counts, logical bytes and bytes saved via dedup
+// This will take in nothing
+// This will return the computed stats, or an error if the CAS directory could not be walked
+func casStatsSnapshot() (casStatsResponse, error) {
+	var resp casStatsResponse
+	var physicalBytes int64
+
+	if _, err := os.Stat(casDir()); os.IsNotExist(err) {
+		return resp, nil
+	}
+
+	err := filepath.Walk(casDir(), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		nlink := int64(1)
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			nlink = int64(stat.Nlink)
+		}
+
+		// st_nlink includes the blob's own CAS link; every other link is a repo directory copy
+		resp.TotalBlobs++
+		resp.TotalLogicalBytes += info.Size() * (nlink - 1)
+		physicalBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	resp.BytesSaved = resp.TotalLogicalBytes - physicalBytes
+	return resp, nil
+}
+
+// handleCASStats(w http.ResponseWriter, r *http.Request)
+// This will report CAS dedup stats as JSON
+// This will take in the response writer and request
+// This will return nothing
+func handleCASStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !casEnabled() {
+		http.Error(w, "CAS is not enabled", http.StatusNotFound)
+		return
+	}
+
+	stats, err := casStatsSnapshot()
+	if err != nil {
+		log.Errorf("Failed to compute CAS stats: %s", err.Error())
+		http.Error(w, "failed to compute CAS stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// gcCASSweep()
+// This will remove CAS blobs with no remaining repo directory hardlinks (st_nlink == 1, i.e.
+// just the CAS copy itself)
+// This will take in nothing
+// This will return nothing
+func gcCASSweep() {
+	dir := casDir()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink <= 1 {
+			log.Infof("Removing orphaned CAS blob %s", p)
+			os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("CAS gc sweep of %s failed: %s", dir, err.Error())
+	}
+}
+
+// startCASGC()
+// This will periodically sweep the CAS directory for orphaned blobs, if CAS is enabled
+// This will take in nothing
+// This will return nothing
+func startCASGC() {
+	if !casEnabled() {
+		return
+	}
+
+	interval := getEnvDurationMS("CAS_GC_INTERVAL_MS", DefaultCASGCInterval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			gcCASSweep()
+		}
+	}()
+}
+
+// Var to hold the compiled regex for pulling a key id out of `gpg --import` output, and the
+// cache of signKey (env value) -> resolved key id so repeated updates don't re-import
+var (
+	gpgImportKeyIDRegex = regexp.MustCompile(`key ([0-9A-F]+):`)
+
+	gpgKeyIDMu    sync.Mutex
+	gpgKeyIDCache = make(map[string]string)
+)
+
+// resolveGPGKeyID(signKey string) (string, error)
+// This will resolve GPG_SIGN_KEY to a key id usable with gpg --local-user, importing it first
+// if it names a file rather than an existing key id
+// This will take in the configured GPG_SIGN_KEY value
+// This will return the resolved key id, or an error if an import was needed and failed
+func resolveGPGKeyID(signKey string) (string, error) {
+	gpgKeyIDMu.Lock()
+	defer gpgKeyIDMu.Unlock()
+
+	if id, ok := gpgKeyIDCache[signKey]; ok {
+		return id, nil
+	}
+
+	info, err := os.Stat(signKey)
+	if err != nil || info.IsDir() {
+		// Not a file on disk, assume it already names a key id in the local keyring
+		gpgKeyIDCache[signKey] = signKey
+		return signKey, nil
+	}
+
+	out, err := exec.Command("gpg", "--batch", "--import", signKey).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("gpg --import %s failed: %s: %s", signKey, err, out)
+	}
+
+	matches := gpgImportKeyIDRegex.FindStringSubmatch(string(out))
+	if matches == nil {
+		return "", fmt.Errorf("could not determine key id from gpg import output: %s", out)
+	}
+
+	gpgKeyIDCache[signKey] = matches[1]
+	return matches[1], nil
+}
+
+// signRepomd(path string) error
+// This will GPG detach-sign repodata/repomd.xml and publish the public key alongside it, if
+// GPG_SIGN_KEY is configured
+// This will take in the repo path
+// This will return an error if signing was configured but failed
+func signRepomd(path string) error {
+	signKey := os.Getenv("GPG_SIGN_KEY")
+	if signKey == "" {
+		return nil
+	}
+
+	keyID, err := resolveGPGKeyID(signKey)
+	if err != nil {
+		return err
+	}
+
+	repodataDir := path + "/repodata"
+	repomd := repodataDir + "/repomd.xml"
+	ascPath := repodataDir + "/repomd.xml.asc"
+
+	args := []string{"--detach-sign", "--armor", "--local-user", keyID, "--output", ascPath}
+	if passFile := os.Getenv("GPG_PASSPHRASE_FILE"); passFile != "" {
+		args = append(args, "--batch", "--pinentry-mode", "loopback", "--passphrase-file", passFile)
+	}
+	args = append(args, repomd)
+
+	log.Infof("Signing %s with GPG key %s", repomd, keyID)
+	if out, err := exec.Command("gpg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg sign of %s failed: %s: %s", repomd, err, out)
+	}
+
+	keyPath := repodataDir + "/repomd.xml.key"
+	exportArgs := []string{"--armor", "--export", keyID, "--output", keyPath}
+	if out, err := exec.Command("gpg", exportArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg export of public key %s failed: %s: %s", keyID, err, out)
+	}
+
+	return nil
+}
+
+// Var to hold the backoff schedule between createrepo --update retries
+var updateRetryBackoff = []time.Duration{time.Second, 4 * time.Second, 16 * time.Second}
+
 func updateRepoCmd(path string) bool {
 	cachedir := path + "/" + "cachedir"
 	cmd := "createrepo"
 	cmdArgs := []string{"--update", path, "--cachedir", cachedir}
+	if workers := getEnvInt("CREATEREPO_WORKERS", 0); workers > 0 {
+		cmdArgs = append(cmdArgs, "--workers", strconv.Itoa(workers))
+	}
 
 	log.Infof("Running command: %s %s", cmd, strings.Join(cmdArgs, " "))
 
-	if err := exec.Command(cmd, cmdArgs...).Run(); err != nil {
+	out, err := exec.Command(cmd, cmdArgs...).CombinedOutput()
+	if err != nil {
+		exitCode := -1
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			status := exitErr.Sys().(syscall.WaitStatus)
-			if status != 0 {
-				log.Errorf("Could not update repo %s", path)
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				exitCode = status.ExitStatus()
 			}
 		} else {
 			checkErrorAndLog(err)
 		}
-	} else {
-		log.Debugf("Successfully updated repo %s", path)
-        return true
+
+		log.WithFields(logrus.Fields{"path": path, "exitCode": exitCode}).Errorf("Could not update repo: %s", strings.TrimSpace(string(out)))
+		return false
+	}
+
+	log.Debugf("Successfully updated repo %s", path)
+	if len(out) > 0 {
+		log.Debugf("createrepo output for %s: %s", path, strings.TrimSpace(string(out)))
 	}
+	return true
+}
 
-    return false
+// updateRepoWithRetry(path string) bool
+// This will run updateRepoCmd, retrying with exponential backoff on transient failures (NFS
+// ESTALE, a concurrent writer) before giving up
+// This will take in the repo path
+// This will return true once an attempt succeeds, false if every attempt failed
+func updateRepoWithRetry(path string) bool {
+	if updateRepoCmd(path) {
+		return true
+	}
+
+	for attempt, backoff := range updateRetryBackoff {
+		log.Warnf("createrepo --update failed for %s, retrying in %s (attempt %d/%d)", path, backoff, attempt+1, len(updateRetryBackoff))
+		time.Sleep(backoff)
+		if updateRepoCmd(path) {
+			return true
+		}
+	}
+
+	return false
 }
 // updateRepo(path *string)
 // This will run the update for the repo
@@ -95,20 +700,57 @@ func updateRepoCmd(path string) bool {
 // This will return nothing
 func updateRepo(path string) {
 
-	lockfile := path + "/" + LockFileName
-	log.Infof("Trying to create lockfile %s", lockfile)
-	golock.Lock(lockfile)
-	
-	// is there a block level defer in go ? 
-	defer golock.Unlock(lockfile)
+	setRepoStatusLocked(path, true)
+	defer setRepoStatusLocked(path, false)
+
+	log.Infof("Locking directory %s", path)
+	unlock := locker.Lock(path)
+	defer unlock()
 	defer log.Infof("Unlocking directory %s", path)
 
-    if !updateRepoCmd(path) {
+	if strings.ToLower(os.Getenv("USE_FILE_LOCK")) == "true" {
+		lockFile, err := acquireFileLock(path)
+		if err != nil {
+			log.Errorf("Failed to acquire file lock for %s: %s", path, err.Error())
+		} else {
+			defer releaseFileLock(lockFile)
+		}
+	}
+
+	start := time.Now()
+	metricRepoUpdatesTotal.Inc()
+
+	if casEnabled() {
+		ingestRPMsToCAS(path)
+	}
+
+	success := updateRepoWithRetry(path)
+    if !success {
         log.Infof("Regenerating whole repo");
         os.RemoveAll(path + "/" + "repodata");
         os.RemoveAll(path + "/" + ".repodata");
-        updateRepoCmd(path)
+        success = updateRepoCmd(path)
     }
+
+	if success {
+		if err := signRepomd(path); err != nil {
+			log.Errorf("Failed to GPG sign repo %s: %s", path, err.Error())
+			if strings.ToLower(os.Getenv("GPG_REQUIRE")) == "true" {
+				log.Errorf("GPG_REQUIRE is set, removing unsigned repodata for %s", path)
+				os.RemoveAll(path + "/" + "repodata")
+				success = false
+			}
+		}
+	}
+
+	metricRepoUpdateDuration.Observe(time.Since(start).Seconds())
+
+	exitCode := 0
+	if !success {
+		exitCode = 1
+		metricRepoUpdateFailuresTotal.Inc()
+	}
+	setRepoStatusResult(path, exitCode)
 }
 
 // findRpms(path string, info os.FileInfo, err error)
@@ -142,11 +784,11 @@ func (paths *rpmPaths) findRpms(path string, info os.FileInfo, err error) error
 	return nil
 }
 
-// initialScanAndUpdate()
+// initialScanAndUpdate(pool *workerPool)
 // This will walk the repo directory and find all directories with rpms and run a repo update
-// This will take in nothing
+// This will take in the worker pool to enqueue the updates onto
 // This will return nothing
-func initialScanAndUpdate() {
+func initialScanAndUpdate(pool *workerPool) {
 
 	log.Info("Running startup update of RPM directories")
 
@@ -164,9 +806,8 @@ func initialScanAndUpdate() {
 	close(ch)
 
 	for rpmPath := range ch {
-        os.RemoveAll(rpmPath + "/" + LockFileName)
-		log.Debugf("Creating go routine to update %s", rpmPath)
-		go updateRepo(rpmPath)
+		log.Debugf("Enqueuing update for %s", rpmPath)
+		pool.enqueue(rpmPath)
 	}
 }
 
@@ -184,12 +825,236 @@ func (paths *rpmPaths) toChannel(ch chan string) {
 	}
 }
 
+// repoStatus holds the latest known state of a repo directory, as reported
+// by the GET /repos control API endpoint
+type repoStatus struct {
+	LastUpdated  time.Time `json:"lastUpdated"`
+	LastExitCode int       `json:"lastExitCode"`
+	Locked       bool      `json:"locked"`
+}
+
+// Var to hold the per-directory status used by the control API, guarded by statusMu
+var (
+	statusMu sync.Mutex
+	statuses = make(map[string]*repoStatus)
+)
+
+// Prometheus metrics exposed on GET /metrics
+var (
+	metricRepoUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "repo_updates_total",
+		Help: "Total number of repo update runs started",
+	})
+	metricRepoUpdateFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "repo_update_failures_total",
+		Help: "Total number of repo update runs that failed, including the regeneration fallback",
+	})
+	metricRepoUpdateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "repo_update_duration_seconds",
+		Help:    "Time taken to complete a repo update run",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricRepoEventsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "repo_events_received_total",
+		Help: "Total number of filesystem events received, by event type",
+	}, []string{"event"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRepoUpdatesTotal,
+		metricRepoUpdateFailuresTotal,
+		metricRepoUpdateDuration,
+		metricRepoEventsReceivedTotal,
+	)
+}
+
+// statusForLocked(path string) *repoStatus
+// This will fetch or create the status entry for a repo path
+// This will take in the repo path; callers must already hold statusMu
+// This will return a pointer to its status entry
+func statusForLocked(path string) *repoStatus {
+	s, ok := statuses[path]
+	if !ok {
+		s = &repoStatus{}
+		statuses[path] = s
+	}
+	return s
+}
+
+// snapshotRepoStatus(path string) repoStatus
+// This will return a copy of path's current status, for callers outside the updateRepo path
+// This will take in the repo path
+// This will return a copy of its status entry (the zero value if none exists yet)
+func snapshotRepoStatus(path string) repoStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	return *statusForLocked(path)
+}
+
+// setRepoStatusLocked(path string, locked bool)
+// This will record whether path's update lock is currently held
+// This will take in the repo path and the new locked state
+// This will return nothing
+func setRepoStatusLocked(path string, locked bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	statusForLocked(path).Locked = locked
+}
+
+// setRepoStatusResult(path string, exitCode int)
+// This will record the outcome of the most recent update run for path
+// This will take in the repo path and the exit code of that run (0 on success)
+// This will return nothing
+func setRepoStatusResult(path string, exitCode int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	s := statusForLocked(path)
+	s.LastUpdated = time.Now()
+	s.LastExitCode = exitCode
+}
+
+// repoListEntry is the JSON shape returned for each directory by GET /repos
+type repoListEntry struct {
+	Path         string    `json:"path"`
+	LastUpdated  time.Time `json:"lastUpdated,omitempty"`
+	LastExitCode int       `json:"lastExitCode"`
+	Locked       bool      `json:"locked"`
+}
+
+// handleListRepos(w http.ResponseWriter, r *http.Request)
+// This will scan RepoDir for directories containing RPMs and return each one's status as JSON
+// This will take in the response writer and request
+// This will return nothing
+func handleListRepos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var paths rpmPaths
+	if err := filepath.Walk(RepoDir, paths.findRpms); err != nil {
+		log.Errorf("Failed to scan %s for /repos: %s", RepoDir, err.Error())
+		http.Error(w, "failed to scan repo directory", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]repoListEntry, 0, len(paths))
+	for _, path := range paths {
+		s := snapshotRepoStatus(path)
+		entries = append(entries, repoListEntry{
+			Path:         path,
+			LastUpdated:  s.LastUpdated,
+			LastExitCode: s.LastExitCode,
+			Locked:       s.Locked,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Errorf("Failed to encode /repos response: %s", err.Error())
+	}
+}
+
+// handleRefreshRepo(w http.ResponseWriter, r *http.Request, pool *workerPool)
+// This will enqueue an immediate update for the path named in a POST /repos/{path}/refresh request
+// This will take in the response writer, request, and worker pool to enqueue onto
+// This will return nothing
+func handleRefreshRepo(w http.ResponseWriter, r *http.Request, pool *workerPool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/refresh") {
+		http.NotFound(w, r)
+		return
+	}
+
+	relPath := strings.TrimPrefix(r.URL.Path, "/repos/")
+	relPath = strings.TrimSuffix(relPath, "/refresh")
+	if relPath == "" || relPath == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	decoded, err := url.PathUnescape(relPath)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(RepoDir, decoded)
+	if rel, err := filepath.Rel(RepoDir, path); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Refresh requested via control API for %s", path)
+	pool.enqueue(path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"path": path, "status": "queued"})
+}
+
+// handleHealthz(w http.ResponseWriter, r *http.Request)
+// This will answer container health/readiness probes
+// This will take in the response writer and request
+// This will return nothing
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// startControlAPI(pool *workerPool)
+// This will start the embedded HTTP control/status server in the background
+// This will take in the worker pool that refresh requests are enqueued onto
+// This will return nothing
+func startControlAPI(pool *workerPool) {
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8081"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos", handleListRepos)
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		handleRefreshRepo(w, r, pool)
+	})
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleHealthz)
+	mux.HandleFunc("/cas/stats", handleCASStats)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("Starting control API on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Control API server stopped: %s", err.Error())
+		}
+	}()
+}
+
 func main() {
 
 	log.Info("Repo scanner starting ...")
 
+	// Set up the bounded worker pool and the per-directory debouncer that
+	// feeds it, so N events for the same directory coalesce into one update
+	pool := newWorkerPool(getEnvInt("WORKERS", runtime.NumCPU()), updateRepo)
+	debounce := newDebouncer(getEnvDurationMS("DEBOUNCE_MS", DefaultDebounceMS*time.Millisecond), pool)
+
+	// Start the embedded control/status API
+	startControlAPI(pool)
+
+	// Start the periodic CAS garbage collection sweep, a no-op unless CAS_ENABLED is set
+	startCASGC()
+
 	// Run the inital scan and update of all repos
-	initialScanAndUpdate()
+	initialScanAndUpdate(pool)
 
 	// Make a buffered channel for file events
 	log.Debug("Making event channel")
@@ -216,6 +1081,7 @@ func main() {
 		event := <-ch
 
 		log.Debugf("Event %s on %s", event.Event().String(), event.Path())
+		metricRepoEventsReceivedTotal.WithLabelValues(event.Event().String()).Inc()
 
 		// if the event was an RPM file
 		if rpmRegex.MatchString(event.Path()) {
@@ -223,7 +1089,7 @@ func main() {
 			// Get the directory and start update
 			rpmDir := filepath.Dir(event.Path())
 			log.Infof("RPM change detected in %s", rpmDir)
-			go updateRepo(rpmDir)
+			debounce.trigger(rpmDir)
 		}
 	}
 }
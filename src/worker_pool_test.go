@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWorkerPoolDrainsManyDistinctPaths enqueues more distinct paths than the old
+// fixed-size backlog channel could buffer (100), to guard against the pool
+// deadlocking when a send would have blocked while holding the bookkeeping mutex.
+func TestWorkerPoolDrainsManyDistinctPaths(t *testing.T) {
+	var mu sync.Mutex
+	done := make(map[string]bool)
+
+	pool := newWorkerPool(4, func(path string) {
+		mu.Lock()
+		done[path] = true
+		mu.Unlock()
+	})
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		pool.enqueue(fmt.Sprintf("/repo/dir-%d", i))
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		mu.Lock()
+		count := len(done)
+		mu.Unlock()
+
+		if count == n {
+			return
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("worker pool did not drain %d distinct paths in time, got %d", n, count)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}